@@ -1,95 +1,222 @@
 package http
 
 import (
+	"context"
 	"net/http"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
 
-	"github.com/prometheus/client_golang/prometheus"
+var (
+	defaultDNSBuckets = []float64{.005, .01, .025, .05}
+	defaultTLSBuckets = []float64{.05, .1, .25, .5}
 )
 
+// RoundTripperOptions configures NewInstrumentedRoundTripperWithOptions.
+// All fields are optional; the zero value reproduces the metric names and
+// buckets NewInstrumentedRoundTripper has always used.
+type RoundTripperOptions struct {
+	// Namespace and Subsystem are prefixed onto every metric name
+	// (namespace_subsystem_metric), so multiple instrumented clients can
+	// share a registry without colliding on metric names. Set these to
+	// something like "telemeter"/"forward" to produce
+	// telemeter_forward_client_api_requests_total, etc.
+	Namespace, Subsystem string
+
+	// DurationBuckets, DNSBuckets, and TLSBuckets override the default
+	// histogram buckets for request, DNS, and TLS handshake latency
+	// respectively. A nil slice keeps the built-in default for that
+	// histogram.
+	DurationBuckets, DNSBuckets, TLSBuckets []float64
+
+	// ConstLabels are attached to every metric registered by this
+	// RoundTripper.
+	ConstLabels prometheus.Labels
+
+	// ExtraLabelNames declares additional label names, beyond the
+	// built-in `client`, `code`, `method`, and `event` labels, that
+	// ExtraLabelsFromContext supplies values for.
+	ExtraLabelNames []string
+
+	// ExtraLabelsFromContext, when set, is called once per request to
+	// derive values for ExtraLabelNames from the request's context (for
+	// example a `target` or `tenant` label). Any name in ExtraLabelNames
+	// it does not return a value for is recorded as an empty string.
+	ExtraLabelsFromContext func(context.Context) prometheus.Labels
+}
+
+// NewInstrumentedRoundTripper wraps next with the standard set of promhttp
+// client-side metrics, labelled by clientName. It is a thin wrapper around
+// NewInstrumentedRoundTripperWithOptions using default metric names and
+// buckets, kept for backward compatibility.
 func NewInstrumentedRoundTripper(reg prometheus.Registerer, clientName string, next http.RoundTripper) http.RoundTripper {
+	return NewInstrumentedRoundTripperWithOptions(reg, clientName, next, RoundTripperOptions{})
+}
+
+// NewInstrumentedRoundTripperWithOptions wraps next with the standard set of
+// promhttp client-side metrics: an in-flight gauge, a request counter
+// (labels `code`, `method`, `client`), DNS and TLS trace latency histograms,
+// and a request duration histogram. opts controls the metric namespace,
+// subsystem, histogram buckets, constant labels, and any extra labels
+// derived per-request from the request context (for example to distinguish
+// a forward-tenant or authorize-target).
+//
+// Use opts.Namespace/Subsystem to run multiple instrumented clients against
+// the same registry: registering two clients with the same metric names but
+// different `client` label values still panics, because the metric
+// descriptors (name + label names) are identical; a distinct namespace or
+// subsystem per client avoids that collision.
+func NewInstrumentedRoundTripperWithOptions(reg prometheus.Registerer, clientName string, next http.RoundTripper, opts RoundTripperOptions) http.RoundTripper {
+	durationBuckets := opts.DurationBuckets
+	if durationBuckets == nil {
+		durationBuckets = prometheus.DefBuckets
+	}
+	dnsBuckets := opts.DNSBuckets
+	if dnsBuckets == nil {
+		dnsBuckets = defaultDNSBuckets
+	}
+	tlsBuckets := opts.TLSBuckets
+	if tlsBuckets == nil {
+		tlsBuckets = defaultTLSBuckets
+	}
+
 	inFlightGaugeVec := promauto.With(reg).NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "client_in_flight_requests",
-			Help: "A gauge of in-flight requests for the wrapped client.",
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "client_in_flight_requests",
+			Help:        "A gauge of in-flight requests for the wrapped client.",
+			ConstLabels: opts.ConstLabels,
 		},
-		[]string{"client"},
+		append([]string{"client"}, opts.ExtraLabelNames...),
 	)
 	counterVec := promauto.With(reg).NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "client_api_requests_total",
-			Help: "A counter for requests from the wrapped client.",
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "client_api_requests_total",
+			Help:        "A counter for requests from the wrapped client.",
+			ConstLabels: opts.ConstLabels,
 		},
-		[]string{"code", "method", "client"},
+		append([]string{"code", "method", "client"}, opts.ExtraLabelNames...),
 	)
 	dnsLatencyVec := promauto.With(reg).NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    "dns_duration_seconds",
-			Help:    "Trace dns latency histogram.",
-			Buckets: []float64{.005, .01, .025, .05},
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "dns_duration_seconds",
+			Help:        "Trace dns latency histogram.",
+			Buckets:     dnsBuckets,
+			ConstLabels: opts.ConstLabels,
 		},
-		[]string{"event", "client"},
+		append([]string{"event", "client"}, opts.ExtraLabelNames...),
 	)
 	tlsLatencyVec := promauto.With(reg).NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    "tls_duration_seconds",
-			Help:    "Trace tls latency histogram.",
-			Buckets: []float64{.05, .1, .25, .5},
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "tls_duration_seconds",
+			Help:        "Trace tls latency histogram.",
+			Buckets:     tlsBuckets,
+			ConstLabels: opts.ConstLabels,
 		},
-		[]string{"event", "client"},
+		append([]string{"event", "client"}, opts.ExtraLabelNames...),
 	)
 	histVec := promauto.With(reg).NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    "request_duration_seconds",
-			Help:    "A histogram of request latencies.",
-			Buckets: prometheus.DefBuckets,
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "request_duration_seconds",
+			Help:        "A histogram of request latencies.",
+			Buckets:     durationBuckets,
+			ConstLabels: opts.ConstLabels,
 		},
-		[]string{"method", "client"},
+		append([]string{"method", "client"}, opts.ExtraLabelNames...),
 	)
 
+	rt := &instrumentedRoundTripper{
+		next:             next,
+		clientName:       clientName,
+		extraLabelNames:  opts.ExtraLabelNames,
+		extraLabelsFn:    opts.ExtraLabelsFromContext,
+		inFlightGaugeVec: inFlightGaugeVec,
+		counterVec:       counterVec,
+		dnsLatencyVec:    dnsLatencyVec,
+		tlsLatencyVec:    tlsLatencyVec,
+		histVec:          histVec,
+	}
+
+	// promhttp does not pass idle connection closer properly, so let's do it on our own.
+	// TODO(bwplotka): Improve promhttp upstream
+	if ic, ok := next.(idleConnectionCloser); ok {
+		return &transportWithIdleConnectionCloser{
+			idleConnectionCloser: ic,
+			RoundTripper:         rt,
+		}
+	}
+	return rt
+}
+
+// instrumentedRoundTripper assembles the promhttp instrumentation chain for
+// each request, so that ExtraLabelsFromContext (when set) can be resolved
+// from the request's context before the label values are curried in.
+type instrumentedRoundTripper struct {
+	next            http.RoundTripper
+	clientName      string
+	extraLabelNames []string
+	extraLabelsFn   func(context.Context) prometheus.Labels
+
+	inFlightGaugeVec *prometheus.GaugeVec
+	counterVec       *prometheus.CounterVec
+	dnsLatencyVec    *prometheus.HistogramVec
+	tlsLatencyVec    *prometheus.HistogramVec
+	histVec          *prometheus.HistogramVec
+}
+
+func (rt *instrumentedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	labels := prometheus.Labels{"client": rt.clientName}
+	for _, name := range rt.extraLabelNames {
+		labels[name] = ""
+	}
+	if rt.extraLabelsFn != nil {
+		for name, value := range rt.extraLabelsFn(req.Context()) {
+			// Only record values for declared label names: the vecs were
+			// built with exactly {"client"} + extraLabelNames, so an
+			// unknown key here would panic on inconsistent cardinality.
+			if _, ok := labels[name]; ok {
+				labels[name] = value
+			}
+		}
+	}
+
+	dnsLatency := rt.dnsLatencyVec.MustCurryWith(labels)
+	tlsLatency := rt.tlsLatencyVec.MustCurryWith(labels)
 	trace := &promhttp.InstrumentTrace{
 		DNSStart: func(t float64) {
-			dnsLatencyVec.
-				WithLabelValues("dns_start", clientName).
-				Observe(t)
+			dnsLatency.WithLabelValues("dns_start").Observe(t)
 		},
 		DNSDone: func(t float64) {
-			dnsLatencyVec.
-				WithLabelValues("dns_done", clientName).
-				Observe(t)
+			dnsLatency.WithLabelValues("dns_done").Observe(t)
 		},
 		TLSHandshakeStart: func(t float64) {
-			tlsLatencyVec.
-				WithLabelValues("tls_handshake_start", clientName).
-				Observe(t)
+			tlsLatency.WithLabelValues("tls_handshake_start").Observe(t)
 		},
 		TLSHandshakeDone: func(t float64) {
-			tlsLatencyVec.
-				WithLabelValues("tls_handshake_done", clientName).
-				Observe(t)
+			tlsLatency.WithLabelValues("tls_handshake_done").Observe(t)
 		},
 	}
 
-	rt := promhttp.InstrumentRoundTripperInFlight(inFlightGaugeVec.WithLabelValues(clientName),
-		promhttp.InstrumentRoundTripperCounter(counterVec.MustCurryWith(prometheus.Labels{"client": clientName}),
+	next := promhttp.InstrumentRoundTripperInFlight(rt.inFlightGaugeVec.With(labels),
+		promhttp.InstrumentRoundTripperCounter(rt.counterVec.MustCurryWith(labels),
 			promhttp.InstrumentRoundTripperTrace(trace,
-				promhttp.InstrumentRoundTripperDuration(histVec.MustCurryWith(prometheus.Labels{"client": clientName}),
-					next),
+				promhttp.InstrumentRoundTripperDuration(rt.histVec.MustCurryWith(labels),
+					rt.next),
 			),
 		),
 	)
-
-	// promhttp does not pass idle connection closer properly, so let's do it on our own.
-	// TODO(bwplotka): Improve promhttp upstream
-	if ic, ok := next.(idleConnectionCloser); ok {
-		return &transportWithIdleConnectionCloser{
-			idleConnectionCloser: ic,
-			RoundTripper:         rt,
-		}
-	}
-	return rt
+	return next.RoundTrip(req)
 }
 
 type idleConnectionCloser interface {
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// sizeBuckets are exponential buckets for request/response body sizes in
+// bytes, starting at 256B and growing by a factor of 4. This mirrors the
+// bucket layout Caddy's caddyhttp metrics use for the same signal.
+var sizeBuckets = prometheus.ExponentialBuckets(256, 4, 8)
+
+// NewInstrumentedHandler wraps next with the standard set of promhttp
+// server-side metrics: in-flight requests, a request counter (labelled
+// `code`, `method`), request duration, and request/response sizes. All
+// metrics carry handlerName as a constant `handler` label rather than a
+// variable one, so NewInstrumentedHandler can be called once per endpoint
+// against the same Registerer without colliding. It is the server-side
+// counterpart to NewInstrumentedRoundTripper and lets callers get
+// consistent per-handler metrics without adding bespoke instrumentation to
+// each http.Handler.
+func NewInstrumentedHandler(reg prometheus.Registerer, handlerName string, next http.Handler) http.Handler {
+	constLabels := prometheus.Labels{"handler": handlerName}
+
+	inFlightGauge := promauto.With(reg).NewGauge(
+		prometheus.GaugeOpts{
+			Name:        "http_in_flight_requests",
+			Help:        "A gauge of in-flight requests being handled by the wrapped handler.",
+			ConstLabels: constLabels,
+		},
+	)
+	counterVec := promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "http_requests_total",
+			Help:        "A counter for requests to the wrapped handler.",
+			ConstLabels: constLabels,
+		},
+		[]string{"code", "method"},
+	)
+	durationVec := promauto.With(reg).NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "http_request_duration_seconds",
+			Help:        "A histogram of latencies for requests to the wrapped handler.",
+			Buckets:     prometheus.DefBuckets,
+			ConstLabels: constLabels,
+		},
+		[]string{"code", "method"},
+	)
+	requestSize := promauto.With(reg).NewHistogram(
+		prometheus.HistogramOpts{
+			Name:        "http_request_size_bytes",
+			Help:        "A histogram of approximate request sizes (URL, method, protocol, headers, host, and the pre-decompression body size from Content-Length) for requests to the wrapped handler.",
+			Buckets:     sizeBuckets,
+			ConstLabels: constLabels,
+		},
+	)
+	responseSize := promauto.With(reg).NewHistogram(
+		prometheus.HistogramOpts{
+			Name:        "http_response_size_bytes",
+			Help:        "A histogram of response sizes for requests to the wrapped handler.",
+			Buckets:     sizeBuckets,
+			ConstLabels: constLabels,
+		},
+	)
+
+	return promhttp.InstrumentHandlerInFlight(inFlightGauge,
+		promhttp.InstrumentHandlerCounter(counterVec,
+			promhttp.InstrumentHandlerDuration(durationVec,
+				promhttp.InstrumentHandlerRequestSize(requestSize,
+					promhttp.InstrumentHandlerResponseSize(responseSize,
+						next,
+					),
+				),
+			),
+		),
+	)
+}
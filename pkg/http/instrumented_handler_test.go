@@ -0,0 +1,34 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestNewInstrumentedHandlerMultipleHandlersOnOneRegistry guards against a
+// regression where the per-vec collectors registered distinct handlerNames
+// as a variable label instead of a constant one: a second call with a
+// different handlerName produced identical descriptors to the first and
+// panicked with an AlreadyRegisteredError.
+func TestNewInstrumentedHandlerMultipleHandlersOnOneRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	upload := NewInstrumentedHandler(reg, "upload", ok)
+	authorize := NewInstrumentedHandler(reg, "authorize", ok)
+
+	for _, h := range []http.Handler{upload, authorize} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+		}
+	}
+
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+}
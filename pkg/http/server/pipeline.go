@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+// familyBatchSize is the number of metric families accumulated before a
+// batch is filtered and handed off to the store, bounding how much of a
+// request is held in memory at once regardless of its total size.
+const familyBatchSize = 100
+
+// pipelineBufferSize is the channel depth between the decode and transform
+// stages of decodeAndStoreMetrics; the transform and write stages are joined
+// by a channel that holds a single batch.
+const pipelineBufferSize = familyBatchSize
+
+// errTooManyFamilies is returned when a request decodes more than
+// Server.maxFamiliesPerRequest metric families.
+var errTooManyFamilies = errors.New("request contains too many metric families")
+
+// streamFunc decodes a request body and emits each metric family it finds
+// onto out, returning as soon as the context is cancelled or the body is
+// exhausted.
+type streamFunc func(ctx context.Context, out chan<- *clientmodel.MetricFamily) error
+
+// streamExposition decodes families one at a time from a text/proto
+// exposition format decoder and emits each as soon as it is decoded. The
+// delimited protobuf decoder reads the body incrementally; expfmt's text
+// decoder parses the whole body on its first Decode call and then hands out
+// the parsed families one at a time.
+func streamExposition(decoder expfmt.Decoder) streamFunc {
+	return func(ctx context.Context, out chan<- *clientmodel.MetricFamily) error {
+		for {
+			family := &clientmodel.MetricFamily{}
+			if err := decoder.Decode(family); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			select {
+			case out <- family:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// streamRemoteWrite decodes an entire remote_write request at once (the
+// wire format is a single protobuf message, so it cannot be decoded
+// incrementally) and then feeds the resulting families through the same
+// bounded channel the exposition format uses, so downstream transform and
+// write stages still run against bounded batches. onDecoded, if non-nil, is
+// called once with the post-decompression body size in bytes.
+func streamRemoteWrite(body io.Reader, onDecoded func(int)) streamFunc {
+	return func(ctx context.Context, out chan<- *clientmodel.MetricFamily) error {
+		families, decodedBytes, err := decodeRemoteWrite(body)
+		if err != nil {
+			return err
+		}
+		if onDecoded != nil {
+			onDecoded(decodedBytes)
+		}
+		for _, family := range families {
+			select {
+			case out <- family:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+}
+
+// firstError records the first non-nil error it is given and ignores the
+// rest, so concurrent pipeline stages can all report failures without a
+// data race.
+type firstError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *firstError) set(err error) {
+	if err == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *firstError) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// decodeAndStoreMetrics runs produce, Filter, Pack, and store.WriteMetrics
+// as three concurrent stages connected by bounded channels: a decoder emits
+// families as it reads them, a transformer batches and filters every
+// familyBatchSize families, and a writer packs and flushes each batch. The
+// families held by the pipeline's own stages are bounded by familyBatchSize
+// rather than the size of the request (a produce func that decodes the whole
+// body up front, such as streamRemoteWrite, still holds all of it), and the
+// write of one batch overlaps with the decoding of the next.
+//
+// If any stage fails, its error is recorded and ctx is cancelled so the
+// earlier stages stop reading/producing promptly; the first error to occur
+// is the one returned.
+func (s *Server) decodeAndStoreMetrics(ctx context.Context, partitionKey string, produce streamFunc, transformer metricfamily.Transformer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	families := make(chan *clientmodel.MetricFamily, pipelineBufferSize)
+	batches := make(chan []*clientmodel.MetricFamily, 1)
+	var errs firstError
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		defer close(families)
+		if err := produce(ctx, families); err != nil && !errors.Is(err, context.Canceled) {
+			errs.set(err)
+			cancel()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer close(batches)
+
+		batch := make([]*clientmodel.MetricFamily, 0, familyBatchSize)
+		seen := 0
+		flush := func() bool {
+			if len(batch) == 0 {
+				return true
+			}
+			if err := metricfamily.Filter(batch, transformer); err != nil {
+				errs.set(err)
+				cancel()
+				return false
+			}
+			select {
+			case batches <- batch:
+			case <-ctx.Done():
+				return false
+			}
+			batch = make([]*clientmodel.MetricFamily, 0, familyBatchSize)
+			return true
+		}
+
+		for family := range families {
+			seen++
+			if s.maxFamiliesPerRequest > 0 && seen > s.maxFamiliesPerRequest {
+				errs.set(errTooManyFamilies)
+				cancel()
+				return
+			}
+			batch = append(batch, family)
+			if len(batch) >= familyBatchSize && !flush() {
+				return
+			}
+		}
+		flush()
+	}()
+
+	go func() {
+		defer wg.Done()
+		for batch := range batches {
+			packed := metricfamily.Pack(batch)
+			if err := s.store.WriteMetrics(ctx, &store.PartitionedMetrics{
+				PartitionKey: partitionKey,
+				Families:     packed,
+			}); err != nil {
+				errs.set(err)
+				cancel()
+			}
+		}
+	}()
+
+	wg.Wait()
+	return errs.get()
+}
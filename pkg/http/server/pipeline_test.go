@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/validate"
+)
+
+// passthroughTransformer implements metricfamily.Transformer without
+// modifying or dropping anything, for tests that only care about batching.
+type passthroughTransformer struct{}
+
+func (passthroughTransformer) Transform(*clientmodel.MetricFamily) error { return nil }
+
+// recordingStore implements store.Store and records the size of every
+// batch it is asked to write, so tests can assert on batching behavior
+// without needing a real backend.
+type recordingStore struct {
+	mu         sync.Mutex
+	batchSizes []int
+	maxBatch   int
+	err        error
+}
+
+func (s *recordingStore) WriteMetrics(_ context.Context, pm *store.PartitionedMetrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	n := len(pm.Families)
+	s.batchSizes = append(s.batchSizes, n)
+	if n > s.maxBatch {
+		s.maxBatch = n
+	}
+	return nil
+}
+
+// fixedValidator implements validate.Validator and always returns the same
+// partition key and transformer, for tests that don't exercise validation.
+type fixedValidator struct {
+	partitionKey string
+	transformer  metricfamily.Transformer
+}
+
+func (v fixedValidator) Validate(context.Context, *http.Request) (string, metricfamily.Transformer, error) {
+	return v.partitionKey, v.transformer, nil
+}
+
+var _ validate.Validator = fixedValidator{}
+
+// newTestServer builds a Server wired to fakes, applying opts on top.
+func newTestServer(st *recordingStore, opts ...Option) *Server {
+	return New(log.NewNopLogger(), st, fixedValidator{partitionKey: "test", transformer: passthroughTransformer{}}, passthroughTransformer{}, prometheus.NewRegistry(), opts...)
+}
+
+// produceN returns a streamFunc emitting n distinct UNTYPED families, each
+// with one sample so that metricfamily.Pack keeps it.
+func produceN(n int) streamFunc {
+	return func(ctx context.Context, out chan<- *clientmodel.MetricFamily) error {
+		for i := 0; i < n; i++ {
+			f := &clientmodel.MetricFamily{
+				Name:   strPtr("metric_" + strconv.Itoa(i)),
+				Type:   clientmodel.MetricType_UNTYPED.Enum(),
+				Metric: []*clientmodel.Metric{{Untyped: &clientmodel.Untyped{Value: new(float64)}}},
+			}
+			select {
+			case out <- f:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+}
+
+func strPtr(s string) *string { return &s }
+
+func TestDecodeAndStoreMetricsBatchesLargeRequests(t *testing.T) {
+	st := &recordingStore{}
+	s := newTestServer(st)
+
+	const total = 250
+	if err := s.decodeAndStoreMetrics(context.Background(), "test", produceN(total), passthroughTransformer{}); err != nil {
+		t.Fatalf("decodeAndStoreMetrics: %v", err)
+	}
+
+	sum := 0
+	for _, n := range st.batchSizes {
+		if n > familyBatchSize {
+			t.Fatalf("batch of %d families exceeds familyBatchSize %d", n, familyBatchSize)
+		}
+		sum += n
+	}
+	if sum != total {
+		t.Fatalf("got %d families written across batches, want %d", sum, total)
+	}
+	if len(st.batchSizes) != 3 {
+		t.Fatalf("got %d batches, want 3 (100, 100, 50)", len(st.batchSizes))
+	}
+}
+
+func TestDecodeAndStoreMetricsMaxFamiliesPerRequest(t *testing.T) {
+	st := &recordingStore{}
+	s := newTestServer(st, WithMaxFamiliesPerRequest(2))
+
+	err := s.decodeAndStoreMetrics(context.Background(), "test", produceN(5), passthroughTransformer{})
+	if !errors.Is(err, errTooManyFamilies) {
+		t.Fatalf("got error %v, want errTooManyFamilies", err)
+	}
+}
+
+func TestPostRejectsOversizedRequestBody(t *testing.T) {
+	st := &recordingStore{}
+	s := newTestServer(st, WithMaxRequestBodyBytes(16))
+
+	// Use the remote_write path: it reads the whole body via ioutil.ReadAll,
+	// which surfaces the *http.MaxBytesError from http.MaxBytesReader
+	// directly, unlike the exposition text parser which may not.
+	body := strings.Repeat("x", 1024)
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	w := httptest.NewRecorder()
+
+	s.Post(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// BenchmarkDecodeAndStoreMetricsBoundedBatchSize demonstrates that the
+// largest batch the writer stage ever sees stays pinned at familyBatchSize
+// regardless of how many families a request contains. It does not measure
+// memory: produceN(n) allocates every one of its n families, so allocs/op
+// below scales with n as expected of the input, not of decodeAndStoreMetrics.
+// What stays flat across n is max-batch-families, which is the bound
+// decodeAndStoreMetrics is actually responsible for.
+func BenchmarkDecodeAndStoreMetricsBoundedBatchSize(b *testing.B) {
+	for _, n := range []int{1_000, 10_000, 100_000} {
+		n := n
+		b.Run(fmt.Sprintf("families=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				st := &recordingStore{}
+				s := newTestServer(st)
+				if err := s.decodeAndStoreMetrics(context.Background(), "test", produceN(n), passthroughTransformer{}); err != nil {
+					b.Fatalf("decodeAndStoreMetrics: %v", err)
+				}
+				if st.maxBatch > familyBatchSize {
+					b.Fatalf("max batch size %d exceeds familyBatchSize %d at families=%d", st.maxBatch, familyBatchSize, n)
+				}
+				b.ReportMetric(float64(st.maxBatch), "max-batch-families")
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// isRemoteWriteRequest reports whether req carries a Prometheus remote_write
+// payload rather than the text/proto exposition format that expfmt already
+// understands.
+func isRemoteWriteRequest(req *http.Request) bool {
+	return req.Header.Get("Content-Type") == "application/x-protobuf" &&
+		req.Header.Get("Content-Encoding") == "snappy" &&
+		req.Header.Get("X-Prometheus-Remote-Write-Version") != ""
+}
+
+// decodeRemoteWrite reads a snappy-block-compressed prompb.WriteRequest from
+// body and translates its time series back into the same
+// []*clientmodel.MetricFamily shape the expfmt decoder produces, so the rest
+// of the ingest pipeline (validator, transformer, Filter, Pack,
+// store.WriteMetrics) can treat both wire formats identically. It also
+// returns the decoded (post-decompression) body size in bytes, since the
+// snappy block format here can't be measured incrementally through a
+// streaming io.Reader the way the exposition format's is.
+//
+// remote_write carries no type information, so the type of each family is
+// inferred from well-known metric name suffixes: "_bucket"/"_sum"/"_count"
+// reconstruct a histogram, a "quantile" label alongside "_sum"/"_count"
+// reconstructs a summary, "_total" is treated as a counter, and everything
+// else is emitted UNTYPED.
+func decodeRemoteWrite(body io.Reader) (families []*clientmodel.MetricFamily, decodedBytes int, err error) {
+	compressed, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, 0, err
+	}
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(raw, &wr); err != nil {
+		return nil, 0, err
+	}
+	return newFamilyBuilder(wr.Timeseries).families(), len(raw), nil
+}
+
+// familyBuilder accumulates prompb.TimeSeries into clientmodel.MetricFamily
+// values, grouping the bucket/sum/count (or quantile/sum/count) components
+// of a single histogram (or summary) observation back into one Metric.
+type familyBuilder struct {
+	families map[string]*clientmodel.MetricFamily
+	order    []string
+
+	// histograms/summaries map a "base metric name + label signature +
+	// timestamp" key to the in-progress Metric being assembled for that
+	// observation.
+	histograms map[string]*clientmodel.Metric
+	summaries  map[string]*clientmodel.Metric
+}
+
+func newFamilyBuilder(series []prompb.TimeSeries) *familyBuilder {
+	b := &familyBuilder{
+		families:   map[string]*clientmodel.MetricFamily{},
+		histograms: map[string]*clientmodel.Metric{},
+		summaries:  map[string]*clientmodel.Metric{},
+	}
+
+	histogramBases, summaryBases := classifyBases(series)
+	for i := range series {
+		ts := &series[i]
+		name, labels := splitNameLabel(ts.Labels)
+		if name == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(name, "_bucket") && histogramBases[strings.TrimSuffix(name, "_bucket")]:
+			base := strings.TrimSuffix(name, "_bucket")
+			le, rest := popLabel(labels, "le")
+			bound, _ := strconv.ParseFloat(le, 64)
+			for _, sample := range ts.Samples {
+				m := b.component(b.histograms, base, rest, sample.Timestamp, clientmodel.MetricType_HISTOGRAM)
+				m.Histogram.Bucket = append(m.Histogram.Bucket, &clientmodel.Bucket{
+					UpperBound:      proto.Float64(bound),
+					CumulativeCount: proto.Uint64(uint64(sample.Value)),
+				})
+			}
+		case strings.HasSuffix(name, "_sum") && histogramBases[strings.TrimSuffix(name, "_sum")]:
+			base := strings.TrimSuffix(name, "_sum")
+			for _, sample := range ts.Samples {
+				m := b.component(b.histograms, base, labels, sample.Timestamp, clientmodel.MetricType_HISTOGRAM)
+				m.Histogram.SampleSum = proto.Float64(sample.Value)
+			}
+		case strings.HasSuffix(name, "_count") && histogramBases[strings.TrimSuffix(name, "_count")]:
+			base := strings.TrimSuffix(name, "_count")
+			for _, sample := range ts.Samples {
+				m := b.component(b.histograms, base, labels, sample.Timestamp, clientmodel.MetricType_HISTOGRAM)
+				m.Histogram.SampleCount = proto.Uint64(uint64(sample.Value))
+			}
+		case summaryBases[name]:
+			quantile, rest := popLabel(labels, "quantile")
+			q, _ := strconv.ParseFloat(quantile, 64)
+			for _, sample := range ts.Samples {
+				m := b.component(b.summaries, name, rest, sample.Timestamp, clientmodel.MetricType_SUMMARY)
+				m.Summary.Quantile = append(m.Summary.Quantile, &clientmodel.Quantile{
+					Quantile: proto.Float64(q),
+					Value:    proto.Float64(sample.Value),
+				})
+			}
+		case strings.HasSuffix(name, "_sum") && summaryBases[strings.TrimSuffix(name, "_sum")]:
+			base := strings.TrimSuffix(name, "_sum")
+			for _, sample := range ts.Samples {
+				m := b.component(b.summaries, base, labels, sample.Timestamp, clientmodel.MetricType_SUMMARY)
+				m.Summary.SampleSum = proto.Float64(sample.Value)
+			}
+		case strings.HasSuffix(name, "_count") && summaryBases[strings.TrimSuffix(name, "_count")]:
+			base := strings.TrimSuffix(name, "_count")
+			for _, sample := range ts.Samples {
+				m := b.component(b.summaries, base, labels, sample.Timestamp, clientmodel.MetricType_SUMMARY)
+				m.Summary.SampleCount = proto.Uint64(uint64(sample.Value))
+			}
+		case strings.HasSuffix(name, "_total"):
+			f := b.family(name, clientmodel.MetricType_COUNTER)
+			for _, sample := range ts.Samples {
+				f.Metric = append(f.Metric, &clientmodel.Metric{
+					Label:       labels,
+					TimestampMs: proto.Int64(sample.Timestamp),
+					Counter:     &clientmodel.Counter{Value: proto.Float64(sample.Value)},
+				})
+			}
+		default:
+			f := b.family(name, clientmodel.MetricType_UNTYPED)
+			for _, sample := range ts.Samples {
+				f.Metric = append(f.Metric, &clientmodel.Metric{
+					Label:       labels,
+					TimestampMs: proto.Int64(sample.Timestamp),
+					Untyped:     &clientmodel.Untyped{Value: proto.Float64(sample.Value)},
+				})
+			}
+		}
+	}
+
+	return b
+}
+
+func (b *familyBuilder) family(name string, typ clientmodel.MetricType) *clientmodel.MetricFamily {
+	f, ok := b.families[name]
+	if !ok {
+		f = &clientmodel.MetricFamily{Name: proto.String(name), Type: typ.Enum()}
+		b.families[name] = f
+		b.order = append(b.order, name)
+	}
+	return f
+}
+
+// component returns the in-progress Metric for (base, labels, timestamp),
+// creating it (and appending it to its family) on first use.
+func (b *familyBuilder) component(index map[string]*clientmodel.Metric, base string, labels []*clientmodel.LabelPair, timestampMs int64, typ clientmodel.MetricType) *clientmodel.Metric {
+	key := base + "\xff" + labelSignature(labels) + "\xff" + strconv.FormatInt(timestampMs, 10)
+	m, ok := index[key]
+	if ok {
+		return m
+	}
+
+	m = &clientmodel.Metric{Label: labels, TimestampMs: proto.Int64(timestampMs)}
+	switch typ {
+	case clientmodel.MetricType_HISTOGRAM:
+		m.Histogram = &clientmodel.Histogram{}
+	case clientmodel.MetricType_SUMMARY:
+		m.Summary = &clientmodel.Summary{}
+	}
+	index[key] = m
+
+	f := b.family(base, typ)
+	f.Metric = append(f.Metric, m)
+	return m
+}
+
+// families returns the accumulated families in a stable, name-sorted order,
+// with histogram buckets sorted by upper bound as clientmodel expects.
+func (b *familyBuilder) families() []*clientmodel.MetricFamily {
+	for _, m := range b.histograms {
+		sort.Slice(m.Histogram.Bucket, func(i, j int) bool {
+			return m.Histogram.Bucket[i].GetUpperBound() < m.Histogram.Bucket[j].GetUpperBound()
+		})
+	}
+	for _, m := range b.summaries {
+		sort.Slice(m.Summary.Quantile, func(i, j int) bool {
+			return m.Summary.Quantile[i].GetQuantile() < m.Summary.Quantile[j].GetQuantile()
+		})
+	}
+
+	sort.Strings(b.order)
+	out := make([]*clientmodel.MetricFamily, 0, len(b.order))
+	for _, name := range b.order {
+		out = append(out, b.families[name])
+	}
+	return out
+}
+
+// classifyBases scans all series once to determine which base metric names
+// are histograms (a "_bucket" series exists) or summaries (an unsuffixed
+// series carrying a "quantile" label exists).
+func classifyBases(series []prompb.TimeSeries) (histogramBases, summaryBases map[string]bool) {
+	histogramBases = map[string]bool{}
+	summaryBases = map[string]bool{}
+	for i := range series {
+		name, labels := splitNameLabel(series[i].Labels)
+		switch {
+		case strings.HasSuffix(name, "_bucket"):
+			histogramBases[strings.TrimSuffix(name, "_bucket")] = true
+		case hasLabel(labels, "quantile"):
+			summaryBases[name] = true
+		}
+	}
+	return histogramBases, summaryBases
+}
+
+// splitNameLabel pulls the __name__ label out of a prompb label set and
+// returns it alongside the remaining labels, converted to clientmodel form.
+func splitNameLabel(in []prompb.Label) (string, []*clientmodel.LabelPair) {
+	name := ""
+	out := make([]*clientmodel.LabelPair, 0, len(in))
+	for _, l := range in {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		out = append(out, &clientmodel.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+	}
+	return name, out
+}
+
+// popLabel returns the value of the named label and the remaining labels
+// with it removed.
+func popLabel(labels []*clientmodel.LabelPair, name string) (string, []*clientmodel.LabelPair) {
+	value := ""
+	out := make([]*clientmodel.LabelPair, 0, len(labels))
+	for _, l := range labels {
+		if l.GetName() == name {
+			value = l.GetValue()
+			continue
+		}
+		out = append(out, l)
+	}
+	return value, out
+}
+
+func hasLabel(labels []*clientmodel.LabelPair, name string) bool {
+	for _, l := range labels {
+		if l.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func labelSignature(labels []*clientmodel.LabelPair) string {
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l.GetName() + "=" + l.GetValue()
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
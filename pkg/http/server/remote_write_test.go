@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func label(name, value string) prompb.Label {
+	return prompb.Label{Name: name, Value: value}
+}
+
+func encodeWriteRequest(t *testing.T, series []prompb.TimeSeries) *bytes.Reader {
+	t.Helper()
+	raw, err := proto.Marshal(&prompb.WriteRequest{Timeseries: series})
+	if err != nil {
+		t.Fatalf("marshal WriteRequest: %v", err)
+	}
+	return bytes.NewReader(snappy.Encode(nil, raw))
+}
+
+func findFamily(families []*clientmodel.MetricFamily, name string) *clientmodel.MetricFamily {
+	for _, f := range families {
+		if f.GetName() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func TestDecodeRemoteWriteHistogram(t *testing.T) {
+	series := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{label("__name__", "http_request_duration_seconds_bucket"), label("le", "0.1")},
+			Samples: []prompb.Sample{{Value: 5, Timestamp: 1}},
+		},
+		{
+			Labels:  []prompb.Label{label("__name__", "http_request_duration_seconds_bucket"), label("le", "+Inf")},
+			Samples: []prompb.Sample{{Value: 9, Timestamp: 1}},
+		},
+		{
+			Labels:  []prompb.Label{label("__name__", "http_request_duration_seconds_sum")},
+			Samples: []prompb.Sample{{Value: 1.23, Timestamp: 1}},
+		},
+		{
+			Labels:  []prompb.Label{label("__name__", "http_request_duration_seconds_count")},
+			Samples: []prompb.Sample{{Value: 9, Timestamp: 1}},
+		},
+	}
+
+	families, _, err := decodeRemoteWrite(encodeWriteRequest(t, series))
+	if err != nil {
+		t.Fatalf("decodeRemoteWrite: %v", err)
+	}
+
+	f := findFamily(families, "http_request_duration_seconds")
+	if f == nil {
+		t.Fatalf("expected a http_request_duration_seconds family, got %v", families)
+	}
+	if f.GetType() != clientmodel.MetricType_HISTOGRAM {
+		t.Fatalf("got type %v, want HISTOGRAM", f.GetType())
+	}
+	if len(f.Metric) != 1 {
+		t.Fatalf("got %d metrics, want 1 merged observation", len(f.Metric))
+	}
+	h := f.Metric[0].GetHistogram()
+	if h.GetSampleCount() != 9 || h.GetSampleSum() != 1.23 {
+		t.Fatalf("got histogram %+v, want count=9 sum=1.23", h)
+	}
+	if len(h.Bucket) != 2 {
+		t.Fatalf("got %d buckets, want 2", len(h.Bucket))
+	}
+	if h.Bucket[0].GetUpperBound() != 0.1 || !math.IsInf(h.Bucket[1].GetUpperBound(), 1) {
+		t.Fatalf("unexpected bucket bounds: %+v", h.Bucket)
+	}
+}
+
+func TestDecodeRemoteWriteSummary(t *testing.T) {
+	series := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{label("__name__", "rpc_latency_seconds"), label("quantile", "0.5")},
+			Samples: []prompb.Sample{{Value: 0.2, Timestamp: 1}},
+		},
+		{
+			Labels:  []prompb.Label{label("__name__", "rpc_latency_seconds"), label("quantile", "0.9")},
+			Samples: []prompb.Sample{{Value: 0.5, Timestamp: 1}},
+		},
+		{
+			Labels:  []prompb.Label{label("__name__", "rpc_latency_seconds_sum")},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: 1}},
+		},
+		{
+			Labels:  []prompb.Label{label("__name__", "rpc_latency_seconds_count")},
+			Samples: []prompb.Sample{{Value: 10, Timestamp: 1}},
+		},
+	}
+
+	families, _, err := decodeRemoteWrite(encodeWriteRequest(t, series))
+	if err != nil {
+		t.Fatalf("decodeRemoteWrite: %v", err)
+	}
+
+	f := findFamily(families, "rpc_latency_seconds")
+	if f == nil || f.GetType() != clientmodel.MetricType_SUMMARY {
+		t.Fatalf("expected a SUMMARY rpc_latency_seconds family, got %+v", f)
+	}
+	if len(f.Metric) != 1 {
+		t.Fatalf("got %d metrics, want 1 merged observation", len(f.Metric))
+	}
+	sm := f.Metric[0].GetSummary()
+	if sm.GetSampleCount() != 10 || sm.GetSampleSum() != 3 {
+		t.Fatalf("got summary %+v, want count=10 sum=3", sm)
+	}
+	if len(sm.Quantile) != 2 || sm.Quantile[0].GetQuantile() != 0.5 || sm.Quantile[1].GetQuantile() != 0.9 {
+		t.Fatalf("unexpected quantiles: %+v", sm.Quantile)
+	}
+}
+
+func TestDecodeRemoteWriteCounterAndUntyped(t *testing.T) {
+	series := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{label("__name__", "requests_total"), label("code", "200")},
+			Samples: []prompb.Sample{{Value: 42, Timestamp: 1}},
+		},
+		{
+			Labels:  []prompb.Label{label("__name__", "up")},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+		},
+	}
+
+	families, decodedBytes, err := decodeRemoteWrite(encodeWriteRequest(t, series))
+	if err != nil {
+		t.Fatalf("decodeRemoteWrite: %v", err)
+	}
+	if decodedBytes <= 0 {
+		t.Fatalf("got decodedBytes %d, want > 0", decodedBytes)
+	}
+
+	counter := findFamily(families, "requests_total")
+	if counter == nil || counter.GetType() != clientmodel.MetricType_COUNTER {
+		t.Fatalf("expected a COUNTER requests_total family, got %+v", counter)
+	}
+	if counter.Metric[0].GetCounter().GetValue() != 42 {
+		t.Fatalf("got counter value %v, want 42", counter.Metric[0].GetCounter().GetValue())
+	}
+
+	untyped := findFamily(families, "up")
+	if untyped == nil || untyped.GetType() != clientmodel.MetricType_UNTYPED {
+		t.Fatalf("expected an UNTYPED up family, got %+v", untyped)
+	}
+	if untyped.Metric[0].GetUntyped().GetValue() != 1 {
+		t.Fatalf("got untyped value %v, want 1", untyped.Metric[0].GetUntyped().GetValue())
+	}
+}
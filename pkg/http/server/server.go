@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"time"
@@ -9,6 +10,8 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 
@@ -18,20 +21,71 @@ import (
 	"github.com/openshift/telemeter/pkg/validate"
 )
 
+// decodedSizeBuckets are exponential buckets for post-decompression body
+// sizes in bytes, matching the bucket layout used for the wire-size
+// histogram that http.NewInstrumentedHandler records.
+var decodedSizeBuckets = prometheus.ExponentialBuckets(256, 4, 8)
+
+// wire formats accepted by Server.Post, used as the "format" label on
+// requestsByFormat.
+const (
+	wireFormatExpositionText = "exposition"
+	wireFormatRemoteWrite    = "remote_write"
+)
+
 type Server struct {
 	store       store.Store
 	transformer metricfamily.Transformer
 	validator   validate.Validator
 	logger      log.Logger
+
+	decodedBodySize  prometheus.Histogram
+	requestsByFormat *prometheus.CounterVec
+
+	maxRequestBodyBytes   int64
+	maxFamiliesPerRequest int
+}
+
+// Option configures optional behavior of a Server.
+type Option func(*Server)
+
+// WithMaxRequestBodyBytes rejects requests whose body exceeds n bytes with a
+// 413 Request Entity Too Large. The limit is enforced as the body is read
+// during decoding, so batches decoded before it is reached may already have
+// been written to the store. A value of 0 (the default) leaves the body size
+// unbounded.
+func WithMaxRequestBodyBytes(n int64) Option {
+	return func(s *Server) { s.maxRequestBodyBytes = n }
+}
+
+// WithMaxFamiliesPerRequest aborts decoding, with a 413 Request Entity Too
+// Large, once more than n metric families have been read from a single
+// request. A value of 0 (the default) leaves the family count unbounded.
+func WithMaxFamiliesPerRequest(n int) Option {
+	return func(s *Server) { s.maxFamiliesPerRequest = n }
 }
 
-func New(logger log.Logger, store store.Store, validator validate.Validator, transformer metricfamily.Transformer) *Server {
-	return &Server{
+func New(logger log.Logger, store store.Store, validator validate.Validator, transformer metricfamily.Transformer, reg prometheus.Registerer, opts ...Option) *Server {
+	s := &Server{
 		store:       store,
 		transformer: transformer,
 		validator:   validator,
 		logger:      log.With(logger, "component", "http/server"),
+
+		decodedBodySize: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "telemeter_server_decoded_body_size_bytes",
+			Help:    "A histogram of decoded (post-decompression) request body sizes handled by the server.",
+			Buckets: decodedSizeBuckets,
+		}),
+		requestsByFormat: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "telemeter_server_requests_by_format_total",
+			Help: "A counter of ingest requests by wire format (exposition or remote_write).",
+		}, []string{"format"}),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 func (s *Server) Post(w http.ResponseWriter, req *http.Request) {
@@ -41,6 +95,10 @@ func (s *Server) Post(w http.ResponseWriter, req *http.Request) {
 	}
 	defer req.Body.Close()
 
+	if s.maxRequestBodyBytes > 0 {
+		req.Body = http.MaxBytesReader(w, req.Body, s.maxRequestBodyBytes)
+	}
+
 	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
 	defer cancel()
 
@@ -54,16 +112,35 @@ func (s *Server) Post(w http.ResponseWriter, req *http.Request) {
 	t.With(transforms)
 	t.With(s.transformer)
 
-	// read the response into memory
-	format := expfmt.ResponseFormat(req.Header)
-	var r io.Reader = req.Body
-	if req.Header.Get("Content-Encoding") == "snappy" {
-		r = snappy.NewReader(r)
+	var (
+		produce      streamFunc
+		requestLabel string
+	)
+	if isRemoteWriteRequest(req) {
+		requestLabel = wireFormatRemoteWrite
+		produce = streamRemoteWrite(req.Body, func(n int) { s.decodedBodySize.Observe(float64(n)) })
+	} else {
+		requestLabel = wireFormatExpositionText
+		format := expfmt.ResponseFormat(req.Header)
+		var r io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "snappy" {
+			r = snappy.NewReader(r)
+		}
+		counter := &byteCounter{r: r}
+		decoder := expfmt.NewDecoder(counter, format)
+		produce = func(ctx context.Context, out chan<- *clientmodel.MetricFamily) error {
+			err := streamExposition(decoder)(ctx, out)
+			s.decodedBodySize.Observe(float64(counter.n))
+			return err
+		}
 	}
-	decoder := expfmt.NewDecoder(r, format)
+	s.requestsByFormat.WithLabelValues(requestLabel).Inc()
 
-	errCh := make(chan error)
-	go func() { errCh <- s.decodeAndStoreMetrics(ctx, partitionKey, decoder, t) }()
+	// Buffered so the goroutine can always deliver its result and exit, even
+	// after Post has already returned on the ctx.Done() branch below and
+	// nothing is left reading errCh.
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.decodeAndStoreMetrics(ctx, partitionKey, produce, t) }()
 
 	select {
 	case <-ctx.Done():
@@ -71,10 +148,13 @@ func (s *Server) Post(w http.ResponseWriter, req *http.Request) {
 		level.Error(s.logger).Log("msg", "timeout processing incoming request")
 		return
 	case err := <-errCh:
-		switch err {
-		case nil:
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case err == nil:
 			break
-		case ratelimited.ErrWriteLimitReached(partitionKey):
+		case errors.As(err, &maxBytesErr), errors.Is(err, errTooManyFamilies):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case err == ratelimited.ErrWriteLimitReached(partitionKey):
 			http.Error(w, err.Error(), http.StatusTooManyRequests)
 		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -83,26 +163,16 @@ func (s *Server) Post(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (s *Server) decodeAndStoreMetrics(ctx context.Context, partitionKey string, decoder expfmt.Decoder, transformer metricfamily.Transformer) error {
-	families := make([]*clientmodel.MetricFamily, 0, 100)
-	for {
-		family := &clientmodel.MetricFamily{}
-		families = append(families, family)
-		if err := decoder.Decode(family); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-	}
-
-	if err := metricfamily.Filter(families, transformer); err != nil {
-		return err
-	}
-	families = metricfamily.Pack(families)
+// byteCounter wraps an io.Reader and tracks the number of bytes read through
+// it, so the server can observe the decoded (post-decompression) body size
+// after decoding completes.
+type byteCounter struct {
+	r io.Reader
+	n int64
+}
 
-	return s.store.WriteMetrics(ctx, &store.PartitionedMetrics{
-		PartitionKey: partitionKey,
-		Families:     families,
-	})
+func (c *byteCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }